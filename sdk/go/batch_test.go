@@ -0,0 +1,133 @@
+package ceriseplugin
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+// countingPlugin's Execute just echoes the ability name and counts calls, so
+// batch tests can assert on both individual results and how many times
+// Execute actually ran.
+type countingPlugin struct {
+	calls chan string
+}
+
+func (p *countingPlugin) GetAbilities() []Ability           { return nil }
+func (p *countingPlugin) OnInitialize(map[string]any) error { return nil }
+func (p *countingPlugin) OnShutdown() error                 { return nil }
+func (p *countingPlugin) Execute(ability string, params map[string]any, actx AbilityContext) (AbilityResult, error) {
+	p.calls <- ability
+	return AbilityResult{Success: true, Data: ability}, nil
+}
+
+// TestBatchEmpty verifies an empty batch array is rejected as an invalid
+// request rather than silently accepted or panicking on an empty items
+// slice.
+func TestBatchEmpty(t *testing.T) {
+	h := newTestHarness(t, &countingPlugin{calls: make(chan string, 8)})
+
+	h.send(`[]`)
+	reply := h.recvObject()
+	errObj, ok := reply["error"].(map[string]any)
+	if !ok || errObj["code"].(float64) != -32600 {
+		t.Fatalf("empty batch reply = %v, want Invalid Request (-32600)", reply)
+	}
+
+	h.send(`{"jsonrpc":"2.0","method":"shutdown","id":1}`)
+	h.recvObject()
+	if err := h.waitDone(); err != nil {
+		t.Fatalf("RunWithTransport returned error: %v", err)
+	}
+}
+
+// TestBatchAllNotifications verifies a batch made entirely of notifications
+// (no "id" on any item) runs every item but writes no response line at all,
+// per the JSON-RPC 2.0 batch spec.
+func TestBatchAllNotifications(t *testing.T) {
+	plugin := &countingPlugin{calls: make(chan string, 8)}
+	h := newTestHarness(t, plugin)
+
+	h.send(`[` +
+		`{"jsonrpc":"2.0","method":"execute","params":{"ability":"a"}},` +
+		`{"jsonrpc":"2.0","method":"execute","params":{"ability":"b"}}` +
+		`]`)
+
+	seen := map[string]bool{}
+	seen[<-plugin.calls] = true
+	seen[<-plugin.calls] = true
+	if !seen["a"] || !seen["b"] {
+		t.Fatalf("executed abilities = %v, want a and b", seen)
+	}
+
+	// Nothing should be written for an all-notification batch, so the next
+	// thing on the wire is this shutdown's own reply.
+	h.send(`{"jsonrpc":"2.0","method":"shutdown","id":1}`)
+	reply := h.recvObject()
+	if reply["id"].(float64) != 1 {
+		t.Fatalf("first reply after an all-notification batch = %v, want the shutdown reply", reply)
+	}
+	if err := h.waitDone(); err != nil {
+		t.Fatalf("RunWithTransport returned error: %v", err)
+	}
+}
+
+// TestBatchMixed verifies a batch mixing notifications and regular requests
+// runs every item but only the requests with an "id" appear in the
+// single-array response.
+func TestBatchMixed(t *testing.T) {
+	plugin := &countingPlugin{calls: make(chan string, 8)}
+	h := newTestHarness(t, plugin)
+
+	h.send(`[` +
+		`{"jsonrpc":"2.0","method":"execute","params":{"ability":"notify-only"}},` +
+		`{"jsonrpc":"2.0","method":"execute","params":{"ability":"a"},"id":1},` +
+		`{"jsonrpc":"2.0","method":"health","id":2}` +
+		`]`)
+
+	seen := map[string]bool{}
+	seen[<-plugin.calls] = true
+	seen[<-plugin.calls] = true
+	if !seen["notify-only"] || !seen["a"] {
+		t.Fatalf("executed abilities = %v, want notify-only and a", seen)
+	}
+
+	var responses []map[string]any
+	if err := json.Unmarshal(h.recvLine(), &responses); err != nil {
+		t.Fatalf("unmarshal batch response: %v", err)
+	}
+	if len(responses) != 2 {
+		t.Fatalf("batch response has %d entries, want 2 (notification excluded)", len(responses))
+	}
+	byID := map[float64]map[string]any{}
+	for _, r := range responses {
+		byID[r["id"].(float64)] = r
+	}
+	if _, ok := byID[1]; !ok {
+		t.Fatalf("batch response missing entry for id 1: %v", responses)
+	}
+	if _, ok := byID[2]; !ok {
+		t.Fatalf("batch response missing entry for id 2: %v", responses)
+	}
+
+	h.send(`{"jsonrpc":"2.0","method":"shutdown","id":3}`)
+	h.recvObject()
+	if err := h.waitDone(); err != nil {
+		t.Fatalf("RunWithTransport returned error: %v", err)
+	}
+}
+
+// TestBatchShutdownUnblocksReadLoop verifies that a "shutdown" arriving as
+// the only item of a batch, with nothing sent afterward, still makes
+// RunWithTransport return. The read loop only rechecks its stop channel
+// before the next ReadMessage call, which on a long-lived connection may
+// otherwise block forever waiting for a message that never comes.
+func TestBatchShutdownUnblocksReadLoop(t *testing.T) {
+	h := newTestHarness(t, &countingPlugin{calls: make(chan string, 8)})
+
+	h.send(`[{"jsonrpc":"2.0","method":"shutdown","id":1}]`)
+	h.recvLine() // the batch's own response array
+
+	if err := h.waitDone(); err != nil {
+		t.Fatalf("RunWithTransport returned error: %v", err)
+	}
+}
@@ -1,31 +1,67 @@
 // Cerise Plugin SDK for Go
 //
-// This SDK implements the newline-delimited JSON-RPC protocol used by Cerise Core.
-// A plugin runs as a subprocess (stdio transport) and responds to:
+// This SDK implements the JSON-RPC protocol used by Cerise Core. A plugin
+// most commonly runs as a subprocess talking newline-delimited JSON-RPC over
+// stdio (Run), but RunWithTransport can instead host it over a Unix socket,
+// TCP, or WebSocket connection as a long-lived daemon. Requests may also
+// arrive batched as a JSON-RPC array, and Execute can call back into Cerise
+// Core (AbilityContext.Host) while it's still running. A plugin responds to:
 // - initialize
 // - execute
 // - health
 // - shutdown
+// - cancel / $/cancelRequest
+// - subscribe / unsubscribe (opt in/out of "ability/progress" notifications)
 package ceriseplugin
 
 import (
-	"bufio"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"os"
+	"io"
+	"sync"
+	"time"
 )
 
+// codeRequestCancelled is the JSON-RPC error code used when an in-flight
+// execute is cancelled before Execute returns, following the same
+// convention as LSP's RequestCancelled.
+const codeRequestCancelled = -32800
+
+// codeDeadlineExceeded is the JSON-RPC error code used when an execute's
+// "deadline"/"timeout_ms" fires before Execute returns.
+const codeDeadlineExceeded = -32001
+
 type AbilityContext struct {
 	UserID      string   `json:"user_id"`
 	SessionID   string   `json:"session_id"`
 	Permissions []string `json:"permissions"`
+
+	// Host lets a plugin call back into Cerise Core while handling an
+	// execute (request additional input, fetch memories, emit log events).
+	// It is populated by Run and is not part of the wire format.
+	Host Host `json:"-"`
+
+	// Notify streams an incremental progress event (e.g. a token of an LLM
+	// response, a file-scan update) as an "ability/progress" notification,
+	// without waiting for Execute to return the final AbilityResult. It is
+	// populated by Run and is not part of the wire format.
+	Notify func(event string, data any) `json:"-"`
+
+	// Context carries this execute's cancellation and, if the caller sent a
+	// "deadline" or "timeout_ms" in the execute params' context object, its
+	// deadline. Plugins that don't implement ContextExecutor can still poll
+	// Context.Done()/Err() to honor cancellation on I/O. It is populated by
+	// Run and is not part of the wire format.
+	Context context.Context `json:"-"`
 }
 
 type AbilityResult struct {
-	Success     bool        `json:"success"`
-	Data        any         `json:"data,omitempty"`
-	Error       *string     `json:"error,omitempty"`
-	EmotionHint *string     `json:"emotion_hint,omitempty"`
+	Success     bool    `json:"success"`
+	Data        any     `json:"data,omitempty"`
+	Error       *string `json:"error,omitempty"`
+	EmotionHint *string `json:"emotion_hint,omitempty"`
 }
 
 type Ability struct {
@@ -41,87 +77,313 @@ type Plugin interface {
 	OnShutdown() error
 }
 
+// ContextExecutor is an optional interface a Plugin may implement to receive
+// a context.Context for its Execute call. Run cancels this context when the
+// peer sends a "cancel" (or "$/cancelRequest") request for the same id,
+// letting long-running abilities (LLM tool use, shell commands, ...) abort
+// instead of blocking the plugin's reader loop. Plugins that don't implement
+// ContextExecutor keep working via the plain Execute method, but can't be
+// cancelled mid-flight.
+type ContextExecutor interface {
+	ExecuteContext(ctx context.Context, ability string, params map[string]any, actx AbilityContext) (AbilityResult, error)
+}
+
+// jsonrpcRequest is also used to decode messages arriving from the host in
+// the other direction: a reply to a Host.Call has no "method" and carries
+// "result"/"error" instead, so Run can tell requests and replies apart on
+// the same multiplexed stream.
 type jsonrpcRequest struct {
-	JSONRPC string         `json:"jsonrpc"`
-	Method  string         `json:"method"`
-	Params  map[string]any `json:"params,omitempty"`
-	ID      any            `json:"id,omitempty"`
+	JSONRPC string          `json:"jsonrpc"`
+	Method  string          `json:"method,omitempty"`
+	Params  map[string]any  `json:"params,omitempty"`
+	ID      any             `json:"id,omitempty"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Error   *jsonrpcError   `json:"error,omitempty"`
 }
 
 type jsonrpcResponse struct {
-	JSONRPC string         `json:"jsonrpc"`
-	Result  any            `json:"result,omitempty"`
-	Error   *jsonrpcError  `json:"error,omitempty"`
-	ID      any            `json:"id,omitempty"`
+	JSONRPC string        `json:"jsonrpc"`
+	Result  any           `json:"result,omitempty"`
+	Error   *jsonrpcError `json:"error,omitempty"`
+	ID      any           `json:"id,omitempty"`
 }
 
 type jsonrpcError struct {
 	Code    int    `json:"code"`
 	Message string `json:"message"`
+	Data    any    `json:"data,omitempty"`
+}
+
+// session holds the state that needs to persist across the lifetime of a
+// single RunWithTransport call: the transport (shared between the main loop
+// and goroutines dispatching executes) and the in-flight cancel funcs that
+// "cancel" requests can look up by id.
+type session struct {
+	plugin Plugin
+
+	writeMu sync.Mutex
+	t       Transport
+
+	wg sync.WaitGroup
+
+	inflightMu sync.Mutex
+	inflight   map[any]context.CancelFunc
+
+	host *hostConn
+
+	subsMu     sync.Mutex
+	subscribed map[string]bool
+
+	stopOnce sync.Once
+	stopCh   chan struct{}
+}
+
+// requestStop asks the read loop in RunWithTransport to exit, used when a
+// "shutdown" arrives inside a batch (and so can't stop the loop
+// synchronously the way a top-level "shutdown" does). Closing stopCh alone
+// isn't enough: the loop only checks it before a ReadMessage call, and that
+// call is likely already blocked waiting on the peer's next message, which
+// on a long-lived socket connection may never come. So requestStop also
+// closes the transport if it supports it, which unblocks that pending read
+// with an error the loop recognizes (via stopCh already being closed) as a
+// clean stop rather than a real I/O failure.
+func (s *session) requestStop() {
+	s.stopOnce.Do(func() {
+		close(s.stopCh)
+		if c, ok := s.t.(io.Closer); ok {
+			_ = c.Close()
+		}
+	})
 }
 
+// Run reads and responds to JSON-RPC requests over stdio. It's a thin
+// wrapper around RunWithTransport for the common subprocess-plugin case.
 func Run(plugin Plugin) error {
-	in := bufio.NewScanner(os.Stdin)
-	// Allow larger payloads than the default 64K.
-	in.Buffer(make([]byte, 0, 1024*1024), 8*1024*1024)
+	return RunWithTransport(plugin, NewStdioTransport())
+}
+
+// RunWithTransport is like Run but reads/writes messages through t instead
+// of assuming stdio, so a plugin can be hosted over a Unix socket, TCP, or
+// WebSocket connection instead of (or in addition to) running as a
+// subprocess.
+func RunWithTransport(plugin Plugin, t Transport) error {
+	s := &session{
+		plugin:   plugin,
+		t:        t,
+		inflight: make(map[any]context.CancelFunc),
+		stopCh:   make(chan struct{}),
+	}
+	s.host = newHostConn(s)
+	// Transports accepted from a TransportListener (Unix socket, TCP,
+	// WebSocket) own a connection that must be released when this session
+	// ends, or a long-lived daemon serving many sessions leaks one fd per
+	// connection. NewStdioTransport's lineTransport doesn't implement
+	// io.Closer, so this is a no-op for the common subprocess case.
+	//
+	// Registered before (so it runs after, since defers are LIFO) the
+	// wg.Wait() below: closing the transport first would yank it out from
+	// under any handleExecute/handleBatch goroutine still writing its
+	// final reply, silently dropping that reply instead of delivering it.
+	defer func() {
+		if c, ok := t.(io.Closer); ok {
+			_ = c.Close()
+		}
+	}()
+	defer s.wg.Wait()
+
+	for {
+		select {
+		case <-s.stopCh:
+			return nil
+		default:
+		}
 
-	out := bufio.NewWriter(os.Stdout)
-	defer out.Flush()
+		raw, err := t.ReadMessage()
+		if err != nil {
+			// requestStop closes the transport to unblock a read that's
+			// parked waiting on the peer's next message; that shows up
+			// here as a read error, not as stopCh alone, so check stopCh
+			// before treating it as a real I/O failure.
+			select {
+			case <-s.stopCh:
+				return nil
+			default:
+			}
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		if len(raw) == 0 {
+			continue
+		}
 
-	running := true
-	for running && in.Scan() {
-		line := in.Bytes()
-		if len(line) == 0 {
+		var msg json.RawMessage
+		if err := json.Unmarshal(raw, &msg); err != nil {
+			s.reply(nil, nil, &jsonrpcError{Code: -32700, Message: fmt.Sprintf("Parse error: %v", err)})
+			continue
+		}
+
+		if isBatch(msg) {
+			// Dispatched on its own goroutine, like "execute", so a batch
+			// in flight (and anything it calls back into, e.g. Host.Call)
+			// doesn't block the read loop from servicing a "cancel" for
+			// one of its items.
+			s.wg.Add(1)
+			go func() {
+				defer s.wg.Done()
+				if s.handleBatch(msg) {
+					s.requestStop()
+				}
+			}()
 			continue
 		}
 
 		var req jsonrpcRequest
-		if err := json.Unmarshal(line, &req); err != nil {
-			resp := jsonrpcResponse{
-				JSONRPC: "2.0",
-				Error:   &jsonrpcError{Code: -32700, Message: fmt.Sprintf("Parse error: %v", err)},
-				ID:      nil,
-			}
-			_ = writeJSON(out, resp)
+		if err := json.Unmarshal(msg, &req); err != nil {
+			s.reply(nil, nil, &jsonrpcError{Code: -32700, Message: fmt.Sprintf("Parse error: %v", err)})
+			continue
+		}
+
+		// A message with no method but a result/error is a reply to one
+		// of our own outstanding Host.Call requests, not a new request.
+		if req.Method == "" && (req.Result != nil || req.Error != nil) {
+			s.host.handleResponse(&req)
 			continue
 		}
 
-		// Notifications have no id; ignore response.
 		isNotification := req.ID == nil
 
-		result, rpcErr, shouldStop := dispatch(plugin, req.Method, req.Params)
+		if req.Method == "execute" {
+			s.wg.Add(1)
+			go s.handleExecute(req, isNotification)
+			continue
+		}
+
+		result, rpcErr, shouldStop := s.dispatch(req.Method, req.Params)
+		if !isNotification {
+			s.reply(req.ID, result, rpcErr)
+		}
 		if shouldStop {
-			running = false
+			return nil
 		}
+	}
+}
 
-		if isNotification {
+// isBatch reports whether raw is a JSON-RPC 2.0 batch (a top-level array)
+// rather than a single request object.
+func isBatch(raw json.RawMessage) bool {
+	for _, b := range raw {
+		switch b {
+		case ' ', '\t', '\r', '\n':
 			continue
+		case '[':
+			return true
+		default:
+			return false
 		}
+	}
+	return false
+}
 
-		resp := jsonrpcResponse{JSONRPC: "2.0", ID: req.ID}
-		if rpcErr != nil {
-			resp.Error = rpcErr
-		} else {
-			resp.Result = result
-		}
+// handleBatch dispatches every element of a JSON-RPC batch concurrently
+// (bounded by maxBatchWorkers), collects the non-notification responses and
+// writes them as a single array on one output line. It reports whether the
+// batch contained a "shutdown" that should stop the run loop.
+func (s *session) handleBatch(raw json.RawMessage) (shouldStop bool) {
+	const maxBatchWorkers = 8
+
+	var items []json.RawMessage
+	if err := json.Unmarshal(raw, &items); err != nil {
+		s.reply(nil, nil, &jsonrpcError{Code: -32700, Message: fmt.Sprintf("Parse error: %v", err)})
+		return false
+	}
+	if len(items) == 0 {
+		s.reply(nil, nil, &jsonrpcError{Code: -32600, Message: "Invalid Request"})
+		return false
+	}
+
+	var (
+		mu        sync.Mutex
+		responses []jsonrpcResponse
+		stopped   bool
+		wg        sync.WaitGroup
+		sem       = make(chan struct{}, maxBatchWorkers)
+	)
+
+	for _, item := range items {
+		item := item
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			var req jsonrpcRequest
+			if err := json.Unmarshal(item, &req); err != nil {
+				mu.Lock()
+				responses = append(responses, jsonrpcResponse{
+					JSONRPC: "2.0",
+					Error:   &jsonrpcError{Code: -32700, Message: fmt.Sprintf("Parse error: %v", err)},
+				})
+				mu.Unlock()
+				return
+			}
+
+			if req.Method == "" && (req.Result != nil || req.Error != nil) {
+				s.host.handleResponse(&req)
+				return
+			}
+
+			isNotification := req.ID == nil
+
+			var result any
+			var rpcErr *jsonrpcError
+			var stop bool
+			if req.Method == "execute" {
+				result, rpcErr = s.execute(req, isNotification)
+			} else {
+				result, rpcErr, stop = s.dispatch(req.Method, req.Params)
+			}
+
+			if stop {
+				mu.Lock()
+				stopped = true
+				mu.Unlock()
+			}
+			if isNotification {
+				return
+			}
+			mu.Lock()
+			responses = append(responses, jsonrpcResponse{JSONRPC: "2.0", ID: req.ID, Result: result, Error: rpcErr})
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
 
-		_ = writeJSON(out, resp)
+	if len(responses) > 0 {
+		s.writeMu.Lock()
+		_ = s.writeJSON(responses)
+		s.writeMu.Unlock()
 	}
 
-	return in.Err()
+	return stopped
 }
 
-func dispatch(plugin Plugin, method string, params map[string]any) (any, *jsonrpcError, bool) {
+func (s *session) dispatch(method string, params map[string]any) (any, *jsonrpcError, bool) {
 	switch method {
 	case "initialize":
+		if ha, ok := s.plugin.(HostAware); ok {
+			ha.SetHost(s.host)
+		}
 		cfg, _ := params["config"].(map[string]any)
 		if cfg == nil {
 			cfg = map[string]any{}
 		}
-		if err := plugin.OnInitialize(cfg); err != nil {
+		if err := s.plugin.OnInitialize(cfg); err != nil {
 			return map[string]any{"success": false, "error": err.Error()}, nil, false
 		}
-		abilities := plugin.GetAbilities()
+		abilities := s.plugin.GetAbilities()
 		return map[string]any{
 			"success":   true,
 			"abilities": abilities,
@@ -129,59 +391,31 @@ func dispatch(plugin Plugin, method string, params map[string]any) (any, *jsonrp
 			"tools":     abilities,
 		}, nil, false
 
-	case "execute":
-		ability, _ := params["ability"].(string)
-		if ability == "" {
-			ability, _ = params["skill"].(string)
-		}
-		if ability == "" {
-			ability, _ = params["tool"].(string)
-		}
-		if ability == "" {
-			ability, _ = params["name"].(string)
-		}
-
-		execParams, _ := params["params"].(map[string]any)
-		if execParams == nil {
-			execParams, _ = params["arguments"].(map[string]any)
-		}
-		if execParams == nil {
-			execParams = map[string]any{}
+	case "cancel", "$/cancelRequest":
+		id := params["id"]
+		s.inflightMu.Lock()
+		cancel, ok := s.inflight[id]
+		s.inflightMu.Unlock()
+		if ok {
+			cancel()
 		}
+		return map[string]any{"cancelled": ok}, nil, false
 
-		ctxRaw, _ := params["context"].(map[string]any)
-		ctx := AbilityContext{}
-		if ctxRaw != nil {
-			if v, ok := ctxRaw["user_id"].(string); ok {
-				ctx.UserID = v
-			}
-			if v, ok := ctxRaw["session_id"].(string); ok {
-				ctx.SessionID = v
-			}
-			if v, ok := ctxRaw["permissions"].([]any); ok {
-				perms := make([]string, 0, len(v))
-				for _, p := range v {
-					if s, ok := p.(string); ok {
-						perms = append(perms, s)
-					}
-				}
-				ctx.Permissions = perms
-			}
-		}
+	case "subscribe":
+		sid, _ := params["session_id"].(string)
+		s.setSubscribed(sid, true)
+		return map[string]any{"subscribed": true}, nil, false
 
-		res, err := plugin.Execute(ability, execParams, ctx)
-		if err != nil {
-			msg := err.Error()
-			res.Success = false
-			res.Error = &msg
-		}
-		return res, nil, false
+	case "unsubscribe":
+		sid, _ := params["session_id"].(string)
+		s.setSubscribed(sid, false)
+		return map[string]any{"subscribed": false}, nil, false
 
 	case "health":
 		return map[string]any{"healthy": true}, nil, false
 
 	case "shutdown":
-		_ = plugin.OnShutdown()
+		_ = s.plugin.OnShutdown()
 		return map[string]any{"success": true}, nil, true
 
 	default:
@@ -189,15 +423,162 @@ func dispatch(plugin Plugin, method string, params map[string]any) (any, *jsonrp
 	}
 }
 
-func writeJSON(w *bufio.Writer, v any) error {
-	b, err := json.Marshal(v)
+// handleExecute runs a Plugin's Execute (or ExecuteContext, if implemented)
+// on its own goroutine, writing the response as soon as it's ready, so that
+// a "cancel" request can be read and dispatched while it's still in flight.
+func (s *session) handleExecute(req jsonrpcRequest, isNotification bool) {
+	defer s.wg.Done()
+
+	result, rpcErr := s.execute(req, isNotification)
+	if isNotification {
+		return
+	}
+	s.reply(req.ID, result, rpcErr)
+}
+
+// execute runs a Plugin's Execute (or ExecuteContext, if implemented),
+// tracking it in s.inflight for the duration so a "cancel" request can abort
+// it. It returns the raw (result, error) pair rather than writing a
+// response, so that both the single-request and batch paths can share it.
+func (s *session) execute(req jsonrpcRequest, isNotification bool) (any, *jsonrpcError) {
+	ability, execParams, actx, deadline, hasDeadline := parseExecuteParams(req.Params)
+	actx.Host = s.host
+	actx.Notify = func(event string, data any) {
+		s.emitProgress(req.ID, actx.SessionID, event, data)
+	}
+
+	baseCtx, baseCancel := context.WithCancel(context.Background())
+	if !isNotification {
+		s.inflightMu.Lock()
+		s.inflight[req.ID] = baseCancel
+		s.inflightMu.Unlock()
+		defer func() {
+			s.inflightMu.Lock()
+			delete(s.inflight, req.ID)
+			s.inflightMu.Unlock()
+		}()
+	}
+	defer baseCancel()
+
+	ctx := baseCtx
+	if hasDeadline {
+		var deadlineCancel context.CancelFunc
+		ctx, deadlineCancel = context.WithDeadline(baseCtx, deadline)
+		defer deadlineCancel()
+	}
+	actx.Context = ctx
+
+	start := time.Now()
+	var res AbilityResult
+	var err error
+	if ce, ok := s.plugin.(ContextExecutor); ok {
+		res, err = ce.ExecuteContext(ctx, ability, execParams, actx)
+	} else {
+		res, err = s.plugin.Execute(ability, execParams, actx)
+	}
+
+	if isNotification {
+		return nil, nil
+	}
+
+	if ctx.Err() == context.DeadlineExceeded {
+		elapsedMs := time.Since(start).Milliseconds()
+		return nil, &jsonrpcError{
+			Code:    codeDeadlineExceeded,
+			Message: "Deadline exceeded",
+			Data:    map[string]any{"elapsed_ms": elapsedMs},
+		}
+	}
+	if ctx.Err() == context.Canceled {
+		return nil, &jsonrpcError{Code: codeRequestCancelled, Message: "Request cancelled"}
+	}
+
 	if err != nil {
-		return err
+		var pluginErr *PluginError
+		if errors.As(err, &pluginErr) {
+			return nil, &jsonrpcError{Code: pluginErr.Code, Message: pluginErr.Message, Data: pluginErr.Data}
+		}
+		msg := err.Error()
+		res.Success = false
+		res.Error = &msg
+	}
+	return res, nil
+}
+
+func parseExecuteParams(params map[string]any) (ability string, execParams map[string]any, actx AbilityContext, deadline time.Time, hasDeadline bool) {
+	ability, _ = params["ability"].(string)
+	if ability == "" {
+		ability, _ = params["skill"].(string)
+	}
+	if ability == "" {
+		ability, _ = params["tool"].(string)
+	}
+	if ability == "" {
+		ability, _ = params["name"].(string)
 	}
-	_, err = w.Write(append(b, '\n'))
+
+	execParams, _ = params["params"].(map[string]any)
+	if execParams == nil {
+		execParams, _ = params["arguments"].(map[string]any)
+	}
+	if execParams == nil {
+		execParams = map[string]any{}
+	}
+
+	ctxRaw, _ := params["context"].(map[string]any)
+	actx = AbilityContext{}
+	if ctxRaw != nil {
+		if v, ok := ctxRaw["user_id"].(string); ok {
+			actx.UserID = v
+		}
+		if v, ok := ctxRaw["session_id"].(string); ok {
+			actx.SessionID = v
+		}
+		if v, ok := ctxRaw["permissions"].([]any); ok {
+			perms := make([]string, 0, len(v))
+			for _, p := range v {
+				if s, ok := p.(string); ok {
+					perms = append(perms, s)
+				}
+			}
+			actx.Permissions = perms
+		}
+
+		if v, ok := ctxRaw["deadline"].(string); ok {
+			if t, err := time.Parse(time.RFC3339, v); err == nil {
+				deadline, hasDeadline = t, true
+			}
+		}
+		if !hasDeadline {
+			if v, ok := ctxRaw["timeout_ms"].(float64); ok && v > 0 {
+				deadline, hasDeadline = time.Now().Add(time.Duration(v)*time.Millisecond), true
+			}
+		}
+	}
+
+	return ability, execParams, actx, deadline, hasDeadline
+}
+
+// reply writes a single JSON-RPC response line, serialized against
+// concurrent writes from other in-flight executes.
+func (s *session) reply(id any, result any, rpcErr *jsonrpcError) {
+	resp := jsonrpcResponse{JSONRPC: "2.0", ID: id}
+	if rpcErr != nil {
+		resp.Error = rpcErr
+	} else {
+		resp.Result = result
+	}
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	_ = s.writeJSON(resp)
+}
+
+// writeJSON marshals v and writes it as a single message through the
+// session's transport. Callers must hold writeMu.
+func (s *session) writeJSON(v any) error {
+	b, err := json.Marshal(v)
 	if err != nil {
 		return err
 	}
-	return w.Flush()
+	return s.t.WriteMessage(b)
 }
-
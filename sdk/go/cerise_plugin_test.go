@@ -0,0 +1,248 @@
+package ceriseplugin
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"testing"
+	"time"
+)
+
+// pipeTransport is a Transport over an in-memory io.Pipe, used by tests to
+// drive RunWithTransport the same way a socket or subprocess transport
+// would, without needing a real subprocess or network connection. It
+// implements io.Closer, like the real socket-backed transports, so tests can
+// exercise RunWithTransport's close-on-stop behavior.
+type pipeTransport struct {
+	sc  *bufio.Scanner
+	in  io.Closer
+	out io.WriteCloser
+}
+
+func newPipeTransport(r io.ReadCloser, w io.WriteCloser) *pipeTransport {
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 0, 64*1024), 8*1024*1024)
+	return &pipeTransport{sc: sc, in: r, out: w}
+}
+
+func (t *pipeTransport) ReadMessage() ([]byte, error) {
+	if !t.sc.Scan() {
+		if err := t.sc.Err(); err != nil {
+			return nil, err
+		}
+		return nil, io.EOF
+	}
+	return append([]byte(nil), t.sc.Bytes()...), nil
+}
+
+func (t *pipeTransport) WriteMessage(b []byte) error {
+	_, err := t.out.Write(append(append([]byte(nil), b...), '\n'))
+	return err
+}
+
+func (t *pipeTransport) Close() error {
+	t.out.Close()
+	return t.in.Close()
+}
+
+// testHarness wires a Plugin up to RunWithTransport over in-memory pipes and
+// gives the test a "core"-side send/recv pair to drive it with, the way
+// Cerise Core would over a real transport. The plugin's outgoing lines are
+// drained into a buffered channel by a background goroutine as soon as
+// they're written, so a test can send several messages before reading any
+// replies without the unbuffered underlying pipe deadlocking either side.
+type testHarness struct {
+	t     *testing.T
+	send  func(line string)
+	lines chan []byte
+	done  chan error
+}
+
+func newTestHarness(t *testing.T, plugin Plugin) *testHarness {
+	t.Helper()
+	coreR, pluginW := io.Pipe()
+	pluginR, coreW := io.Pipe()
+
+	tr := newPipeTransport(pluginR, pluginW)
+
+	h := &testHarness{
+		t: t,
+		send: func(line string) {
+			if _, err := coreW.Write([]byte(line + "\n")); err != nil {
+				t.Fatalf("write to plugin: %v", err)
+			}
+		},
+		lines: make(chan []byte, 64),
+		done:  make(chan error, 1),
+	}
+	t.Cleanup(func() {
+		coreW.Close()
+		pluginW.Close()
+	})
+
+	go func() {
+		sc := bufio.NewScanner(coreR)
+		sc.Buffer(make([]byte, 0, 64*1024), 8*1024*1024)
+		for sc.Scan() {
+			h.lines <- append([]byte(nil), sc.Bytes()...)
+		}
+		close(h.lines)
+	}()
+	go func() { h.done <- RunWithTransport(plugin, tr) }()
+	return h
+}
+
+// recvLine reads the next line the plugin wrote (a reply, a batch response
+// array, or a notification), failing the test if none arrives in time.
+func (h *testHarness) recvLine() []byte {
+	h.t.Helper()
+	select {
+	case line, ok := <-h.lines:
+		if !ok {
+			h.t.Fatal("plugin closed its output")
+		}
+		return line
+	case <-time.After(2 * time.Second):
+		h.t.Fatal("timed out waiting for a message from the plugin")
+		return nil
+	}
+}
+
+func (h *testHarness) recvObject() map[string]any {
+	h.t.Helper()
+	var msg map[string]any
+	if err := json.Unmarshal(h.recvLine(), &msg); err != nil {
+		h.t.Fatalf("unmarshal plugin message: %v", err)
+	}
+	return msg
+}
+
+// waitDone blocks until RunWithTransport returns (e.g. after "shutdown"),
+// failing the test if it doesn't within the timeout.
+func (h *testHarness) waitDone() error {
+	h.t.Helper()
+	select {
+	case err := <-h.done:
+		return err
+	case <-time.After(2 * time.Second):
+		h.t.Fatal("RunWithTransport did not return in time")
+		return nil
+	}
+}
+
+// blockingPlugin's Execute blocks until its context is cancelled (or the
+// test releases it via unblock), so tests can exercise cancellation and
+// deadlines without racing a real long-running operation.
+type blockingPlugin struct {
+	unblock chan struct{}
+}
+
+func (blockingPlugin) GetAbilities() []Ability           { return nil }
+func (blockingPlugin) OnInitialize(map[string]any) error { return nil }
+func (blockingPlugin) OnShutdown() error                 { return nil }
+
+// Execute is never called: blockingPlugin implements ContextExecutor, which
+// Run prefers, but the Plugin interface still requires it.
+func (blockingPlugin) Execute(ability string, params map[string]any, actx AbilityContext) (AbilityResult, error) {
+	return AbilityResult{Success: true}, nil
+}
+
+func (p blockingPlugin) ExecuteContext(ctx context.Context, ability string, params map[string]any, actx AbilityContext) (AbilityResult, error) {
+	select {
+	case <-ctx.Done():
+	case <-p.unblock:
+	}
+	return AbilityResult{Success: true}, nil
+}
+
+// delayPlugin's Execute runs for a fixed duration regardless of context
+// cancellation, simulating an ability that's still in flight when
+// "shutdown" arrives (shutdown stops the read loop, but doesn't cancel
+// already-running executes the way "cancel" does).
+type delayPlugin struct {
+	delay time.Duration
+}
+
+func (delayPlugin) GetAbilities() []Ability           { return nil }
+func (delayPlugin) OnInitialize(map[string]any) error { return nil }
+func (delayPlugin) OnShutdown() error                 { return nil }
+func (p delayPlugin) Execute(ability string, params map[string]any, actx AbilityContext) (AbilityResult, error) {
+	time.Sleep(p.delay)
+	return AbilityResult{Success: true}, nil
+}
+
+// TestInFlightExecuteReplyDeliveredAfterShutdown verifies that an execute
+// still running when "shutdown" arrives gets its real reply delivered once
+// it finishes, rather than having the transport closed out from under it
+// the moment RunWithTransport's read loop returns.
+func TestInFlightExecuteReplyDeliveredAfterShutdown(t *testing.T) {
+	h := newTestHarness(t, delayPlugin{delay: 150 * time.Millisecond})
+
+	h.send(`{"jsonrpc":"2.0","method":"execute","params":{"ability":"slow"},"id":1}`)
+	time.Sleep(20 * time.Millisecond)
+	h.send(`{"jsonrpc":"2.0","method":"shutdown","id":2}`)
+
+	first := h.recvObject()
+	second := h.recvObject()
+
+	var executeReply, shutdownReply map[string]any
+	for _, msg := range []map[string]any{first, second} {
+		switch msg["id"].(float64) {
+		case 1:
+			executeReply = msg
+		case 2:
+			shutdownReply = msg
+		}
+	}
+	if executeReply == nil {
+		t.Fatalf("execute(id=1)'s reply was never delivered; got %v and %v", first, second)
+	}
+	if result, ok := executeReply["result"].(map[string]any); !ok || result["success"] != true {
+		t.Fatalf("execute reply = %v, want a successful result", executeReply)
+	}
+	if shutdownReply == nil {
+		t.Fatalf("shutdown(id=2)'s reply was never delivered; got %v and %v", first, second)
+	}
+
+	if err := h.waitDone(); err != nil {
+		t.Fatalf("RunWithTransport returned error: %v", err)
+	}
+}
+
+// TestCancelAfterExecuteReturns verifies that a "cancel" for a request whose
+// Execute has already completed (and so is no longer in s.inflight) is a
+// no-op reported via "cancelled": false, rather than somehow producing a
+// spurious cancellation result for a request that already got its real
+// response.
+func TestCancelAfterExecuteReturns(t *testing.T) {
+	plugin := blockingPlugin{unblock: make(chan struct{})}
+	h := newTestHarness(t, plugin)
+
+	close(plugin.unblock) // let Execute return immediately once called
+	h.send(`{"jsonrpc":"2.0","method":"execute","params":{"ability":"noop"},"id":1}`)
+
+	reply := h.recvObject()
+	if reply["id"].(float64) != 1 {
+		t.Fatalf("reply id = %v, want 1", reply["id"])
+	}
+	result, ok := reply["result"].(map[string]any)
+	if !ok || result["success"] != true {
+		t.Fatalf("execute reply = %v, want a successful result", reply)
+	}
+
+	// By now Execute has returned and removed itself from s.inflight, so
+	// this cancel targets a request that's already done.
+	h.send(`{"jsonrpc":"2.0","method":"cancel","params":{"id":1},"id":2}`)
+	cancelReply := h.recvObject()
+	cancelResult, ok := cancelReply["result"].(map[string]any)
+	if !ok || cancelResult["cancelled"] != false {
+		t.Fatalf("cancel reply = %v, want cancelled: false", cancelReply)
+	}
+
+	h.send(`{"jsonrpc":"2.0","method":"shutdown","id":3}`)
+	h.recvObject() // shutdown's own reply; must be drained before the pipe can close
+	if err := h.waitDone(); err != nil {
+		t.Fatalf("RunWithTransport returned error: %v", err)
+	}
+}
@@ -0,0 +1,35 @@
+package ceriseplugin
+
+import "testing"
+
+// TestDeadlineExceededProducesStructuredError verifies that an execute whose
+// context deadline fires before a ContextExecutor returns gets back the
+// structured codeDeadlineExceeded error (with elapsed_ms data), rather than
+// whatever result/error ExecuteContext happens to return after ctx expires.
+func TestDeadlineExceededProducesStructuredError(t *testing.T) {
+	h := newTestHarness(t, blockingPlugin{unblock: make(chan struct{})})
+
+	h.send(`{"jsonrpc":"2.0","method":"execute","params":{"ability":"slow","context":{"timeout_ms":10}},"id":1}`)
+
+	reply := h.recvObject()
+	errObj, ok := reply["error"].(map[string]any)
+	if !ok {
+		t.Fatalf("reply = %v, want a deadline-exceeded error", reply)
+	}
+	if errObj["code"].(float64) != float64(codeDeadlineExceeded) {
+		t.Fatalf("error code = %v, want %d", errObj["code"], codeDeadlineExceeded)
+	}
+	data, ok := errObj["data"].(map[string]any)
+	if !ok {
+		t.Fatalf("error data = %v, want an elapsed_ms payload", errObj["data"])
+	}
+	if _, ok := data["elapsed_ms"]; !ok {
+		t.Fatalf("error data = %v, missing elapsed_ms", data)
+	}
+
+	h.send(`{"jsonrpc":"2.0","method":"shutdown","id":2}`)
+	h.recvObject()
+	if err := h.waitDone(); err != nil {
+		t.Fatalf("RunWithTransport returned error: %v", err)
+	}
+}
@@ -0,0 +1,38 @@
+package ceriseplugin
+
+import "fmt"
+
+// Standard PluginError codes, so Cerise Core can react to a failure
+// programmatically instead of string-matching AbilityResult.Error. These
+// are application-level codes, not protocol ones: JSON-RPC 2.0 reserves
+// -32768..-32000 for the spec's own pre-defined and implementation-defined
+// errors (this SDK already uses -32001 for codeDeadlineExceeded there, and
+// -32800 for codeRequestCancelled, following LSP's convention), so plugin
+// codes deliberately stay clear of that whole range. Plugins are free to
+// define their own codes outside it too.
+const (
+	CodePermissionDenied = 40100
+	CodeNotFound         = 40400
+	CodeInvalidParams    = 40001
+	CodeRateLimited      = 42900
+)
+
+// PluginError is an error a Plugin can return from Execute or
+// ExecuteContext to have Run emit it as a structured JSON-RPC error object
+// (code, message, and an optional data payload) instead of flattening it
+// into AbilityResult.Error as a plain string:
+//
+//	return AbilityResult{}, &ceriseplugin.PluginError{
+//		Code:    ceriseplugin.CodePermissionDenied,
+//		Message: "permission denied",
+//		Data:    map[string]any{"required": "fs.write"},
+//	}
+type PluginError struct {
+	Code    int
+	Message string
+	Data    any
+}
+
+func (e *PluginError) Error() string {
+	return fmt.Sprintf("plugin error %d: %s", e.Code, e.Message)
+}
@@ -0,0 +1,52 @@
+package ceriseplugin
+
+import "testing"
+
+// pluginErrorPlugin's Execute always returns a *PluginError, so tests can
+// check how Run maps it onto the wire.
+type pluginErrorPlugin struct{}
+
+func (pluginErrorPlugin) GetAbilities() []Ability           { return nil }
+func (pluginErrorPlugin) OnInitialize(map[string]any) error { return nil }
+func (pluginErrorPlugin) OnShutdown() error                 { return nil }
+func (pluginErrorPlugin) Execute(ability string, params map[string]any, actx AbilityContext) (AbilityResult, error) {
+	return AbilityResult{}, &PluginError{
+		Code:    CodePermissionDenied,
+		Message: "permission denied",
+		Data:    map[string]any{"required": "fs.write"},
+	}
+}
+
+// TestPluginErrorMapsToJSONRPCError verifies a *PluginError returned from
+// Execute is emitted as a structured JSON-RPC error object (code, message,
+// data), not flattened into AbilityResult.Error as a plain string.
+func TestPluginErrorMapsToJSONRPCError(t *testing.T) {
+	h := newTestHarness(t, pluginErrorPlugin{})
+
+	h.send(`{"jsonrpc":"2.0","method":"execute","params":{"ability":"x"},"id":1}`)
+
+	reply := h.recvObject()
+	if _, hasResult := reply["result"]; hasResult {
+		t.Fatalf("reply = %v, want no result alongside a PluginError", reply)
+	}
+	errObj, ok := reply["error"].(map[string]any)
+	if !ok {
+		t.Fatalf("reply = %v, want a structured error", reply)
+	}
+	if errObj["code"].(float64) != float64(CodePermissionDenied) {
+		t.Fatalf("error code = %v, want %d", errObj["code"], CodePermissionDenied)
+	}
+	if errObj["message"] != "permission denied" {
+		t.Fatalf("error message = %v, want %q", errObj["message"], "permission denied")
+	}
+	data, ok := errObj["data"].(map[string]any)
+	if !ok || data["required"] != "fs.write" {
+		t.Fatalf("error data = %v, want required: fs.write", errObj["data"])
+	}
+
+	h.send(`{"jsonrpc":"2.0","method":"shutdown","id":2}`)
+	h.recvObject()
+	if err := h.waitDone(); err != nil {
+		t.Fatalf("RunWithTransport returned error: %v", err)
+	}
+}
@@ -0,0 +1,134 @@
+package ceriseplugin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+// Host lets a plugin call back into Cerise Core while handling an execute,
+// instead of only ever responding to it. It's handed to plugins via
+// AbilityContext.Host and, for initialization-time use, via the optional
+// HostAware interface.
+type Host interface {
+	// Call sends a JSON-RPC request to the host and blocks for its
+	// response, decoding the result into result (which should be a
+	// pointer, as with json.Unmarshal). It returns ctx.Err() if ctx is
+	// done before a response arrives.
+	Call(ctx context.Context, method string, params any, result any) error
+
+	// Notify sends a JSON-RPC notification to the host; it does not wait
+	// for (or expect) a response.
+	Notify(method string, params any) error
+}
+
+// HostAware is an optional interface a Plugin may implement to receive its
+// Host handle before OnInitialize is called.
+type HostAware interface {
+	SetHost(host Host)
+}
+
+// hostConn is the Run-owned Host implementation. Requests flow out over the
+// same writer (and writeMu) that response lines use; replies flow back in
+// through Run's read loop, which routes them here by id via handleResponse.
+type hostConn struct {
+	s      *session
+	nextID int64
+
+	pendingMu sync.Mutex
+	pending   map[any]chan *jsonrpcRequest
+}
+
+func newHostConn(s *session) *hostConn {
+	return &hostConn{s: s, pending: make(map[any]chan *jsonrpcRequest)}
+}
+
+func (h *hostConn) Call(ctx context.Context, method string, params any, result any) error {
+	id := h.nextWireID()
+
+	ch := make(chan *jsonrpcRequest, 1)
+	h.pendingMu.Lock()
+	h.pending[id] = ch
+	h.pendingMu.Unlock()
+	defer func() {
+		h.pendingMu.Lock()
+		delete(h.pending, id)
+		h.pendingMu.Unlock()
+	}()
+
+	reqParams, err := toParamsMap(params)
+	if err != nil {
+		return err
+	}
+	req := jsonrpcRequest{JSONRPC: "2.0", Method: method, Params: reqParams, ID: id}
+
+	h.s.writeMu.Lock()
+	err = h.s.writeJSON(req)
+	h.s.writeMu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case resp := <-ch:
+		if resp.Error != nil {
+			return fmt.Errorf("host call %q: %s (code %d)", method, resp.Error.Message, resp.Error.Code)
+		}
+		if result != nil && len(resp.Result) > 0 {
+			return json.Unmarshal(resp.Result, result)
+		}
+		return nil
+	}
+}
+
+func (h *hostConn) Notify(method string, params any) error {
+	reqParams, err := toParamsMap(params)
+	if err != nil {
+		return err
+	}
+	req := jsonrpcRequest{JSONRPC: "2.0", Method: method, Params: reqParams}
+
+	h.s.writeMu.Lock()
+	defer h.s.writeMu.Unlock()
+	return h.s.writeJSON(req)
+}
+
+// handleResponse routes a reply to an outstanding Call back to its waiting
+// goroutine. Replies with no matching pending call (already timed out, or
+// spurious) are dropped.
+func (h *hostConn) handleResponse(resp *jsonrpcRequest) {
+	h.pendingMu.Lock()
+	ch, ok := h.pending[resp.ID]
+	h.pendingMu.Unlock()
+	if ok {
+		ch <- resp
+	}
+}
+
+// nextWireID returns the next outgoing call id as a float64, matching how
+// encoding/json will decode it back out of the peer's reply.
+func (h *hostConn) nextWireID() any {
+	return float64(atomic.AddInt64(&h.nextID, 1))
+}
+
+func toParamsMap(params any) (map[string]any, error) {
+	if params == nil {
+		return nil, nil
+	}
+	if m, ok := params.(map[string]any); ok {
+		return m, nil
+	}
+	b, err := json.Marshal(params)
+	if err != nil {
+		return nil, err
+	}
+	var m map[string]any
+	if err := json.Unmarshal(b, &m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
@@ -0,0 +1,74 @@
+package ceriseplugin
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+)
+
+// callingPlugin's Execute calls back into the host via Host.Call and
+// Host.Notify, so tests can drive the bidirectional RPC path end to end.
+type callingPlugin struct{}
+
+func (callingPlugin) GetAbilities() []Ability           { return nil }
+func (callingPlugin) OnInitialize(map[string]any) error { return nil }
+func (callingPlugin) OnShutdown() error                 { return nil }
+func (callingPlugin) Execute(ability string, params map[string]any, actx AbilityContext) (AbilityResult, error) {
+	if err := actx.Host.Notify("core/log", map[string]any{"msg": "starting"}); err != nil {
+		return AbilityResult{}, err
+	}
+	var out map[string]any
+	if err := actx.Host.Call(context.Background(), "core/memory.fetch", map[string]any{"key": "x"}, &out); err != nil {
+		return AbilityResult{}, err
+	}
+	return AbilityResult{Success: true, Data: out}, nil
+}
+
+// TestHostCallAndNotifyRoundTrip drives a plugin's Host.Notify (fire and
+// forget) and Host.Call (request/response) against a fake core that replies
+// on the same multiplexed stream Run reads requests from.
+func TestHostCallAndNotifyRoundTrip(t *testing.T) {
+	h := newTestHarness(t, callingPlugin{})
+
+	h.send(`{"jsonrpc":"2.0","method":"execute","params":{"ability":"x"},"id":1}`)
+
+	notif := h.recvObject()
+	if notif["method"] != "core/log" {
+		t.Fatalf("first outbound message = %v, want a core/log notification", notif)
+	}
+	if _, hasID := notif["id"]; hasID {
+		t.Fatalf("core/log notification has an id: %v, want none", notif)
+	}
+
+	call := h.recvObject()
+	if call["method"] != "core/memory.fetch" {
+		t.Fatalf("second outbound message = %v, want a core/memory.fetch call", call)
+	}
+	callID := call["id"]
+	if callID == nil {
+		t.Fatalf("core/memory.fetch call has no id: %v", call)
+	}
+
+	reply, _ := json.Marshal(map[string]any{
+		"jsonrpc": "2.0",
+		"id":      callID,
+		"result":  map[string]any{"value": "cached"},
+	})
+	h.send(string(reply))
+
+	execReply := h.recvObject()
+	result, ok := execReply["result"].(map[string]any)
+	if !ok || result["success"] != true {
+		t.Fatalf("execute reply = %v, want a successful result", execReply)
+	}
+	data, ok := result["data"].(map[string]any)
+	if !ok || data["value"] != "cached" {
+		t.Fatalf("execute result data = %v, want value: cached (the Host.Call's response)", result)
+	}
+
+	h.send(`{"jsonrpc":"2.0","method":"shutdown","id":2}`)
+	h.recvObject()
+	if err := h.waitDone(); err != nil {
+		t.Fatalf("RunWithTransport returned error: %v", err)
+	}
+}
@@ -0,0 +1,45 @@
+package ceriseplugin
+
+// emitProgress sends an "ability/progress" notification for the in-flight
+// execute identified by reqID, if the session has subscribed to high
+// frequency events via "subscribe". Unsubscribed sessions (the default)
+// only ever receive the final AbilityResult, so a plugin that calls
+// AbilityContext.Notify without the peer opting in doesn't flood stdout.
+func (s *session) emitProgress(reqID any, sessionID, event string, data any) {
+	if !s.isSubscribed(sessionID) {
+		return
+	}
+
+	notif := map[string]any{
+		"jsonrpc": "2.0",
+		"method":  "ability/progress",
+		"params": map[string]any{
+			"id":    reqID,
+			"event": event,
+			"data":  data,
+		},
+	}
+
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	_ = s.writeJSON(notif)
+}
+
+func (s *session) isSubscribed(sessionID string) bool {
+	s.subsMu.Lock()
+	defer s.subsMu.Unlock()
+	return s.subscribed[sessionID]
+}
+
+func (s *session) setSubscribed(sessionID string, subscribed bool) {
+	s.subsMu.Lock()
+	defer s.subsMu.Unlock()
+	if s.subscribed == nil {
+		s.subscribed = make(map[string]bool)
+	}
+	if subscribed {
+		s.subscribed[sessionID] = true
+	} else {
+		delete(s.subscribed, sessionID)
+	}
+}
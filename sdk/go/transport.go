@@ -0,0 +1,427 @@
+package ceriseplugin
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// Transport carries newline-delimited JSON-RPC messages between Run and a
+// peer. ReadMessage returns one decoded message at a time (with any framing
+// stripped); WriteMessage sends one. Implementations need not be safe for
+// concurrent use — RunWithTransport serializes all writes itself.
+type Transport interface {
+	ReadMessage() ([]byte, error)
+	WriteMessage([]byte) error
+}
+
+// NewStdioTransport returns a Transport backed by the process's stdin and
+// stdout, framing messages with newlines. This is how Cerise Core talks to
+// plugins it spawns as subprocesses.
+func NewStdioTransport() Transport {
+	return newLineTransport(os.Stdin, os.Stdout)
+}
+
+// lineTransport implements Transport over any io.Reader/io.Writer pair by
+// framing each message with a trailing newline, matching the wire format
+// Run has always used for stdio.
+type lineTransport struct {
+	in  *bufio.Scanner
+	out io.Writer
+}
+
+func newLineTransport(r io.Reader, w io.Writer) *lineTransport {
+	sc := bufio.NewScanner(r)
+	// Allow larger payloads than the default 64K.
+	sc.Buffer(make([]byte, 0, 1024*1024), 8*1024*1024)
+	return &lineTransport{in: sc, out: w}
+}
+
+func (t *lineTransport) ReadMessage() ([]byte, error) {
+	for t.in.Scan() {
+		line := t.in.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+		return append([]byte(nil), line...), nil
+	}
+	if err := t.in.Err(); err != nil {
+		return nil, err
+	}
+	return nil, io.EOF
+}
+
+func (t *lineTransport) WriteMessage(b []byte) error {
+	_, err := t.out.Write(append(append([]byte(nil), b...), '\n'))
+	return err
+}
+
+// closingLineTransport is a lineTransport that also owns (and closes) the
+// underlying connection, for transports dialed or accepted by this package.
+type closingLineTransport struct {
+	*lineTransport
+	conn io.Closer
+}
+
+func newClosingLineTransport(conn net.Conn) *closingLineTransport {
+	return &closingLineTransport{lineTransport: newLineTransport(conn, conn), conn: conn}
+}
+
+func (t *closingLineTransport) Close() error { return t.conn.Close() }
+
+// NewUnixSocketTransport dials the Unix domain socket at path and returns a
+// Transport over that connection. Use this to connect to a long-lived
+// plugin daemon instead of spawning a subprocess per session.
+func NewUnixSocketTransport(path string) (Transport, error) {
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("dial unix socket %s: %w", path, err)
+	}
+	return newClosingLineTransport(conn), nil
+}
+
+// TransportListener accepts a sequence of Transports from successive peer
+// connections, so a plugin daemon can keep serving after one session ends
+// instead of exiting with its listener. Accept blocks until a connection
+// arrives (returning its framed Transport) or the listener is closed.
+type TransportListener interface {
+	Accept() (Transport, error)
+	Close() error
+}
+
+// netListener adapts a net.Listener into a TransportListener by framing each
+// accepted connection the same way the dialing constructors do.
+type netListener struct {
+	ln net.Listener
+}
+
+func (l *netListener) Accept() (Transport, error) {
+	conn, err := l.ln.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return newClosingLineTransport(conn), nil
+}
+
+func (l *netListener) Close() error { return l.ln.Close() }
+
+// NewUnixSocketServerTransport listens on the Unix domain socket at path and
+// returns a TransportListener that hands back a Transport for each
+// connection accepted on it, in turn. This is the server-side counterpart to
+// NewUnixSocketTransport, for a plugin that runs as a long-lived daemon
+// rather than a per-session subprocess: call Accept in a loop, serving each
+// returned Transport with RunWithTransport, to handle reconnects without
+// respawning or re-listening.
+func NewUnixSocketServerTransport(path string) (TransportListener, error) {
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("listen on unix socket %s: %w", path, err)
+	}
+	return &netListener{ln: ln}, nil
+}
+
+// NewTCPTransport dials addr and returns a Transport over that connection.
+func NewTCPTransport(addr string) (Transport, error) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("dial tcp %s: %w", addr, err)
+	}
+	return newClosingLineTransport(conn), nil
+}
+
+// NewTCPServerTransport listens on addr and returns a TransportListener that
+// hands back a Transport for each connection accepted on it, in turn. This
+// is the server-side counterpart to NewTCPTransport, for hosting a plugin
+// daemon reachable over the network: call Accept in a loop, serving each
+// returned Transport with RunWithTransport, to handle reconnects without
+// respawning or re-listening.
+func NewTCPServerTransport(addr string) (TransportListener, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("listen on tcp %s: %w", addr, err)
+	}
+	return &netListener{ln: ln}, nil
+}
+
+// NewWebSocketTransport dials rawURL (ws:// or wss://) and returns a
+// Transport that exchanges one JSON-RPC message per WebSocket text frame.
+// It speaks just enough of RFC 6455 for unfragmented text messages, which is
+// all Run's newline-delimited protocol needs once reframed onto WebSocket.
+func NewWebSocketTransport(rawURL string) (Transport, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("parse websocket url %s: %w", rawURL, err)
+	}
+
+	network := "tcp"
+	addr := u.Host
+	switch u.Scheme {
+	case "ws":
+		if !strings.Contains(addr, ":") {
+			addr += ":80"
+		}
+	case "wss":
+		return nil, fmt.Errorf("websocket scheme %q: wss is not supported, dial a TLS conn and wrap it instead", u.Scheme)
+	default:
+		return nil, fmt.Errorf("unsupported websocket scheme %q", u.Scheme)
+	}
+
+	conn, err := net.Dial(network, addr)
+	if err != nil {
+		return nil, fmt.Errorf("dial websocket %s: %w", rawURL, err)
+	}
+
+	if err := wsClientHandshake(conn, u); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return newWSTransport(conn, true), nil
+}
+
+// wsListener adapts a net.Listener into a TransportListener, running the
+// WebSocket server handshake on each accepted connection before handing it
+// back.
+type wsListener struct {
+	ln net.Listener
+}
+
+func (l *wsListener) Accept() (Transport, error) {
+	conn, err := l.ln.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if err := wsServerHandshake(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return newWSTransport(conn, false), nil
+}
+
+func (l *wsListener) Close() error { return l.ln.Close() }
+
+// NewWebSocketServerTransport listens on addr and returns a TransportListener
+// that upgrades each connection accepted on it to a WebSocket in turn. This
+// is the server-accept counterpart to NewWebSocketTransport: call Accept in
+// a loop, serving each returned Transport with RunWithTransport, to handle
+// reconnects without respawning or re-listening.
+func NewWebSocketServerTransport(addr string) (TransportListener, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("listen on tcp %s: %w", addr, err)
+	}
+	return &wsListener{ln: ln}, nil
+}
+
+const wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+func wsClientHandshake(conn net.Conn, u *url.URL) error {
+	keyBytes := make([]byte, 16)
+	if _, err := rand.Read(keyBytes); err != nil {
+		return fmt.Errorf("generate websocket key: %w", err)
+	}
+	key := base64.StdEncoding.EncodeToString(keyBytes)
+
+	path := u.RequestURI()
+	if path == "" {
+		path = "/"
+	}
+	req := "GET " + path + " HTTP/1.1\r\n" +
+		"Host: " + u.Host + "\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Key: " + key + "\r\n" +
+		"Sec-WebSocket-Version: 13\r\n\r\n"
+	if _, err := conn.Write([]byte(req)); err != nil {
+		return fmt.Errorf("send websocket handshake: %w", err)
+	}
+
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		return fmt.Errorf("read websocket handshake response: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		return fmt.Errorf("websocket handshake failed: %s", resp.Status)
+	}
+
+	want := wsAcceptKey(key)
+	if resp.Header.Get("Sec-WebSocket-Accept") != want {
+		return fmt.Errorf("websocket handshake failed: unexpected Sec-WebSocket-Accept")
+	}
+	return nil
+}
+
+func wsServerHandshake(conn net.Conn) error {
+	br := bufio.NewReader(conn)
+	req, err := http.ReadRequest(br)
+	if err != nil {
+		return fmt.Errorf("read websocket handshake request: %w", err)
+	}
+	key := req.Header.Get("Sec-WebSocket-Key")
+	if key == "" || !strings.EqualFold(req.Header.Get("Upgrade"), "websocket") {
+		return fmt.Errorf("not a websocket upgrade request")
+	}
+
+	resp := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + wsAcceptKey(key) + "\r\n\r\n"
+	_, err = conn.Write([]byte(resp))
+	return err
+}
+
+func wsAcceptKey(key string) string {
+	h := sha1.New()
+	h.Write([]byte(key + wsGUID))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// wsTransport frames each JSON-RPC message as a single, unfragmented
+// WebSocket text frame (opcode 0x1). Client frames are masked per RFC 6455;
+// server frames are not.
+type wsTransport struct {
+	conn     net.Conn
+	br       *bufio.Reader
+	isClient bool
+}
+
+func newWSTransport(conn net.Conn, isClient bool) *wsTransport {
+	return &wsTransport{conn: conn, br: bufio.NewReader(conn), isClient: isClient}
+}
+
+func (t *wsTransport) Close() error { return t.conn.Close() }
+
+func (t *wsTransport) ReadMessage() ([]byte, error) {
+	for {
+		fin, opcode, payload, err := t.readFrame()
+		if err != nil {
+			return nil, err
+		}
+		if !fin {
+			return nil, fmt.Errorf("websocket transport: fragmented frames are not supported")
+		}
+		switch opcode {
+		case 0x1, 0x2: // text, binary
+			return payload, nil
+		case 0x8: // close
+			return nil, io.EOF
+		case 0x9, 0xA: // ping, pong
+			continue
+		default:
+			return nil, fmt.Errorf("websocket transport: unsupported opcode 0x%x", opcode)
+		}
+	}
+}
+
+// maxWSFrameSize bounds a single WebSocket frame's payload, matching the
+// 8MB cap lineTransport already applies to stdio/Unix/TCP messages via
+// bufio.Scanner.Buffer. Without it, a peer can claim an arbitrary length in
+// the frame header and crash the process via an oversized make([]byte, ...).
+const maxWSFrameSize = 8 * 1024 * 1024
+
+func (t *wsTransport) readFrame() (fin bool, opcode byte, payload []byte, err error) {
+	header := make([]byte, 2)
+	if _, err = io.ReadFull(t.br, header); err != nil {
+		return false, 0, nil, err
+	}
+	fin = header[0]&0x80 != 0
+	opcode = header[0] & 0x0F
+	masked := header[1]&0x80 != 0
+	length := uint64(header[1] & 0x7F)
+
+	switch length {
+	case 126:
+		ext := make([]byte, 2)
+		if _, err = io.ReadFull(t.br, ext); err != nil {
+			return false, 0, nil, err
+		}
+		length = uint64(ext[0])<<8 | uint64(ext[1])
+	case 127:
+		ext := make([]byte, 8)
+		if _, err = io.ReadFull(t.br, ext); err != nil {
+			return false, 0, nil, err
+		}
+		length = 0
+		for _, b := range ext {
+			length = length<<8 | uint64(b)
+		}
+	}
+
+	if length > maxWSFrameSize {
+		return false, 0, nil, fmt.Errorf("websocket transport: frame length %d exceeds max %d", length, maxWSFrameSize)
+	}
+
+	var maskKey [4]byte
+	if masked {
+		if _, err = io.ReadFull(t.br, maskKey[:]); err != nil {
+			return false, 0, nil, err
+		}
+	}
+
+	payload = make([]byte, length)
+	if _, err = io.ReadFull(t.br, payload); err != nil {
+		return false, 0, nil, err
+	}
+	if masked {
+		for i := range payload {
+			payload[i] ^= maskKey[i%4]
+		}
+	}
+	return fin, opcode, payload, nil
+}
+
+func (t *wsTransport) WriteMessage(b []byte) error {
+	var header []byte
+	length := len(b)
+
+	maskBit := byte(0)
+	if t.isClient {
+		maskBit = 0x80
+	}
+
+	switch {
+	case length <= 125:
+		header = []byte{0x80 | 0x1, maskBit | byte(length)}
+	case length <= 0xFFFF:
+		header = []byte{0x80 | 0x1, maskBit | 126, byte(length >> 8), byte(length)}
+	default:
+		header = make([]byte, 10)
+		header[0] = 0x80 | 0x1
+		header[1] = maskBit | 127
+		for i := 0; i < 8; i++ {
+			header[9-i] = byte(length >> (8 * i))
+		}
+	}
+
+	if _, err := t.conn.Write(header); err != nil {
+		return err
+	}
+
+	if !t.isClient {
+		_, err := t.conn.Write(b)
+		return err
+	}
+
+	var maskKey [4]byte
+	if _, err := rand.Read(maskKey[:]); err != nil {
+		return err
+	}
+	if _, err := t.conn.Write(maskKey[:]); err != nil {
+		return err
+	}
+	masked := make([]byte, length)
+	for i, c := range b {
+		masked[i] = c ^ maskKey[i%4]
+	}
+	_, err := t.conn.Write(masked)
+	return err
+}